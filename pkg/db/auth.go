@@ -0,0 +1,95 @@
+package db
+
+import (
+	"database/sql"
+
+	"github.com/jmoiron/sqlx"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// BcryptCost is the work factor used to hash new login keys and to
+// rotate legacy plaintext ones. bcrypt.DefaultCost keeps verification
+// well under 250ms on typical lobby hardware; raise it only after
+// checking that latency budget still holds.
+var BcryptCost = bcrypt.DefaultCost
+
+// loginKeyPrefixLen is how many characters of a login key are kept in
+// cleartext (account.login_key_prefix) so GetAccountByLoginKey can narrow
+// its lookup to a handful of candidate rows before paying for a bcrypt
+// compare.
+const loginKeyPrefixLen = 8
+
+func loginKeyPrefix(key string) string {
+	if len(key) <= loginKeyPrefixLen {
+		return key
+	}
+	return key[:loginKeyPrefixLen]
+}
+
+func hashLoginKey(key string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(key), BcryptCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// getAccountByLoginKey verifies key against account.login_key_hash. Rows
+// registered before this hashing scheme existed still have an empty
+// login_key_hash; for those it falls back to the legacy plaintext
+// comparison and then transparently rewrites the row to the hashed form,
+// so existing players keep working without a forced re-registration.
+func getAccountByLoginKey(sdb *sqlx.DB, key string) (*Account, error) {
+	prefix := loginKeyPrefix(key)
+
+	candidates := []*Account{}
+	err := sdb.Select(&candidates, sdb.Rebind(`SELECT * FROM account WHERE login_key_prefix = ?`), prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, a := range candidates {
+		if a.LoginKeyHash == "" {
+			continue
+		}
+		if bcrypt.CompareHashAndPassword([]byte(a.LoginKeyHash), []byte(key)) == nil {
+			return a, nil
+		}
+	}
+
+	// Legacy plaintext row: login_key_prefix was never populated for it,
+	// so it can't have matched above. Fall back to the old exact match.
+	a := &Account{}
+	if err := sdb.Get(a, sdb.Rebind(`SELECT * FROM account WHERE login_key = ? AND login_key_hash = ''`), key); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, sql.ErrNoRows
+		}
+		return nil, err
+	}
+
+	if err := rotateLoginKeyToHash(sdb, a, key); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// rotateLoginKeyToHash hashes key and stores it on a's row so future
+// logins skip the plaintext fallback.
+func rotateLoginKeyToHash(sdb *sqlx.DB, a *Account, key string) error {
+	hash, err := hashLoginKey(key)
+	if err != nil {
+		return err
+	}
+	prefix := loginKeyPrefix(key)
+
+	_, err = sdb.Exec(sdb.Rebind(`
+UPDATE account SET login_key_hash = ?, login_key_prefix = ? WHERE login_key = ?`),
+		hash, prefix, a.LoginKey)
+	if err != nil {
+		return err
+	}
+
+	a.LoginKeyHash = hash
+	a.LoginKeyPrefix = prefix
+	return nil
+}
@@ -0,0 +1,31 @@
+package db
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// TestBcryptCostUnder250ms guards the latency budget BcryptCost's doc
+// comment promises: hashing and verifying a login key should stay well
+// under 250ms on typical lobby hardware. If this starts failing, either
+// the cost was raised without re-checking the budget or the CI hardware
+// is unexpectedly slow.
+func TestBcryptCostUnder250ms(t *testing.T) {
+	const key = "test-login-key-0123456789"
+
+	start := time.Now()
+	hash, err := hashLoginKey(key)
+	if err != nil {
+		t.Fatalf("hashLoginKey: %v", err)
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(key)); err != nil {
+		t.Fatalf("bcrypt compare: %v", err)
+	}
+	elapsed := time.Since(start)
+
+	if elapsed > 250*time.Millisecond {
+		t.Errorf("hash+verify took %s, want < 250ms at BcryptCost=%d", elapsed, BcryptCost)
+	}
+}
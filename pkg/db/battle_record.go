@@ -0,0 +1,78 @@
+package db
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+func addBattleRecord(sdb *sqlx.DB, battleRecord *BattleRecord) error {
+	now := time.Now()
+	battleRecord.Updated = now
+	battleRecord.Created = now
+	_, err := sdb.NamedExec(`
+INSERT INTO battle_record
+	(battle_code, user_id, user_name, pilot_name, players, aggregate, pos, side, created, updated, system)
+VALUES
+	(:battle_code, :user_id, :user_name, :pilot_name, :players, :aggregate, :pos, :side, :created, :updated, :system)`,
+		battleRecord)
+	return err
+}
+
+func updateBattleRecord(sdb *sqlx.DB, cache *SQLiteCache, battle *BattleRecord) error {
+	battle.Updated = time.Now()
+	_, err := sdb.NamedExec(`
+UPDATE battle_record
+SET
+	round = :round,
+	win = :win,
+	lose = :lose,
+	kill = :kill,
+	death = :death,
+	frame = :frame,
+	result = :result,
+	updated = :updated,
+	system = :system
+WHERE
+	battle_code = :battle_code AND user_id = :user_id`, battle)
+
+	if err == nil && battle.Aggregate != 0 {
+		// mark rankings stale; RankingRefresher recomputes them on its
+		// own schedule so a battle update doesn't force a synchronous scan
+		cache.markRankingStale()
+	}
+	return err
+}
+
+func getBattleRecordUser(sdb *sqlx.DB, battleCode string, userID string) (*BattleRecord, error) {
+	b := new(BattleRecord)
+	err := sdb.Get(b, sdb.Rebind(`SELECT * FROM battle_record WHERE battle_code = ? AND user_id = ?`), battleCode, userID)
+	return b, err
+}
+
+func calculateUserTotalBattleCount(sdb *sqlx.DB, dlc dialect, userID string, side byte, includeArchive bool) (ret BattleCountResult, err error) {
+	sumSQL := fmt.Sprintf("SELECT %s, %s, %s, %s, %s FROM %s",
+		dlc.sumAgg("round"), dlc.sumAgg("win"), dlc.sumAgg("lose"), dlc.sumAgg("kill"), dlc.sumAgg("death"),
+		battleRecordSource(DefaultBattleRecordRetention.ArchiveTable, includeArchive))
+	if side == 0 {
+		r := sdb.QueryRow(sdb.Rebind(sumSQL+`
+			WHERE user_id = ? AND aggregate <> 0 AND players = 4`), userID)
+		err = r.Scan(&ret.Battle, &ret.Win, &ret.Lose, &ret.Kill, &ret.Death)
+		return
+	}
+	r := sdb.QueryRow(sdb.Rebind(sumSQL+`
+		WHERE user_id = ? AND aggregate <> 0 AND players = 4 AND side = ?`), userID, side)
+	err = r.Scan(&ret.Battle, &ret.Win, &ret.Lose, &ret.Kill, &ret.Death)
+	return
+}
+
+func calculateUserDailyBattleCount(sdb *sqlx.DB, dlc dialect, userID string) (ret BattleCountResult, err error) {
+	sumSQL := fmt.Sprintf("SELECT %s, %s, %s, %s, %s FROM battle_record",
+		dlc.sumAgg("round"), dlc.sumAgg("win"), dlc.sumAgg("lose"), dlc.sumAgg("kill"), dlc.sumAgg("death"))
+	r := sdb.QueryRow(sdb.Rebind(sumSQL+`
+		WHERE user_id = ? AND aggregate <> 0 AND players = 4 AND created > ?`),
+		userID, time.Now().AddDate(0, 0, -1))
+	err = r.Scan(&ret.Battle, &ret.Win, &ret.Lose, &ret.Kill, &ret.Death)
+	return
+}
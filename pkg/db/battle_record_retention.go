@@ -0,0 +1,51 @@
+package db
+
+import (
+	"log"
+	"time"
+)
+
+// BattleRecordRetention runs PruneBattleRecords on a timer, moving
+// battle_record rows older than cfg.MaxAge into the archive table so the
+// hot table stays bounded for the RANK() ranking scans and
+// CalculateUserTotalBattleCount. PruneBattleRecords always archives into
+// DefaultBattleRecordRetention.ArchiveTable; cfg.ArchiveTable is not read.
+type BattleRecordRetention struct {
+	db  DB
+	cfg RetentionPolicy
+
+	stop chan struct{}
+}
+
+// NewBattleRecordRetention builds a sweeper for cfg. Run it in its own
+// goroutine via Start; Stop ends the loop.
+func NewBattleRecordRetention(db DB, cfg RetentionPolicy) *BattleRecordRetention {
+	return &BattleRecordRetention{db: db, cfg: cfg, stop: make(chan struct{})}
+}
+
+// Start sweeps once, then again on every tick of cfg.CheckInterval, until
+// Stop is called.
+func (r *BattleRecordRetention) Start() {
+	r.sweep()
+	ticker := time.NewTicker(r.cfg.CheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.sweep()
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// Stop ends the loop started by Start.
+func (r *BattleRecordRetention) Stop() {
+	close(r.stop)
+}
+
+func (r *BattleRecordRetention) sweep() {
+	if err := r.db.PruneBattleRecords(time.Now().Add(-r.cfg.MaxAge)); err != nil {
+		log.Printf("db: battle_record retention sweep failed: %v", err)
+	}
+}
@@ -0,0 +1,109 @@
+package db
+
+import (
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// dailyRankingDateFormat is the canonical date key used in daily_ranking
+// and in DailyRankingRequest/DailyRankingResponse.
+const dailyRankingDateFormat = "2006-01-02"
+
+// RankingResetConfig configures a PeriodicRankingReset. Period is the
+// label stamped onto each archived daily_ranking row; Interval is how
+// often the reset runs. Only Period "daily" with a 24h Interval is
+// meaningful today - see the PeriodicRankingReset doc comment.
+type RankingResetConfig struct {
+	Period   string
+	Interval time.Duration
+}
+
+// DefaultDailyRankingReset is the config NewDailyRankingReset uses.
+var DefaultDailyRankingReset = RankingResetConfig{Period: "daily", Interval: 24 * time.Hour}
+
+// getDailySeedForToday returns the canonical key for today's ranking
+// cycle, in UTC, shared by both the live "today" lookup and the nightly
+// reset job.
+func getDailySeedForToday() string {
+	return time.Now().UTC().Format(dailyRankingDateFormat)
+}
+
+// queryPeriodicRanking returns the top 100 for (period, date). If date is
+// today's seed, it's computed live from the user table's not-yet-reset
+// daily_* columns; otherwise it's read back from the daily_ranking
+// archive written by the last reset.
+func queryPeriodicRanking(sdb *sqlx.DB, dlc dialect, period, date string) ([]*RankingRecord, error) {
+	if date == getDailySeedForToday() {
+		rows, err := sdb.Queryx(sdb.Rebind(`
+			SELECT RANK() OVER(ORDER BY daily_win_count DESC) as rank,
+			user_id, name, team,
+			daily_battle_count as battle_count, daily_win_count as win_count, daily_lose_count as lose_count,
+			daily_kill_count as kill_count, daily_death_count as death_count,
+			0 as aeug_battle_count, 0 as aeug_win_count, 0 as aeug_lose_count, 0 as aeug_kill_count, 0 as aeug_death_count,
+			0 as titans_battle_count, 0 as titans_win_count, 0 as titans_lose_count, 0 as titans_kill_count, 0 as titans_death_count
+			FROM `+dlc.userTable()+` ORDER BY rank LIMIT ?`), 100)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		return scanRankingRows(rows)
+	}
+
+	rows, err := sdb.Queryx(sdb.Rebind(`
+		SELECT rank,
+		user_id, '' as name, '' as team,
+		0 as battle_count, win as win_count, lose as lose_count, kill as kill_count, death as death_count,
+		0 as aeug_battle_count, 0 as aeug_win_count, 0 as aeug_lose_count, 0 as aeug_kill_count, 0 as aeug_death_count,
+		0 as titans_battle_count, 0 as titans_win_count, 0 as titans_lose_count, 0 as titans_kill_count, 0 as titans_death_count
+		FROM daily_ranking WHERE period = ? AND date = ? ORDER BY rank LIMIT ?`), period, date, 100)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanRankingRows(rows)
+}
+
+// resetPeriodicRanking snapshots the user table's daily_* columns into
+// daily_ranking under (period, yesterday) and zeroes them, all in one
+// transaction so a battle finishing mid-reset can't be double-counted or
+// silently dropped. at is when the reset fires (just after UTC
+// midnight), so the snapshot is stamped with the day that just ended,
+// not the one that's starting.
+func resetPeriodicRanking(sdb *sqlx.DB, dlc dialect, period string, at time.Time) error {
+	at = at.UTC()
+	dayStart := time.Date(at.Year(), at.Month(), at.Day(), 0, 0, 0, 0, time.UTC)
+	date := dayStart.Add(-time.Nanosecond).Format(dailyRankingDateFormat)
+
+	tx, err := sdb.Beginx()
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(tx.Rebind(`DELETE FROM daily_ranking WHERE period = ? AND date = ?`), period, date); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if _, err := tx.Exec(tx.Rebind(`
+INSERT INTO daily_ranking (period, date, user_id, win, lose, kill, death, rank)
+SELECT ?, ?, user_id, daily_win_count, daily_lose_count, daily_kill_count, daily_death_count,
+	RANK() OVER(ORDER BY daily_win_count DESC)
+FROM `+dlc.userTable()), period, date); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if _, err := tx.Exec(`
+UPDATE ` + dlc.userTable() + ` SET
+	daily_battle_count = 0,
+	daily_win_count = 0,
+	daily_lose_count = 0,
+	daily_kill_count = 0,
+	daily_death_count = 0`); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,106 @@
+package db
+
+import (
+	"flag"
+	"fmt"
+	"time"
+)
+
+// DB is the storage interface implemented by each supported SQL backend.
+// Callers should depend on DB rather than a concrete type (SQLiteDB,
+// PostgresDB) so the lobby can run against either one unmodified.
+type DB interface {
+	Init() error
+	Migrate() error
+
+	RegisterAccount(ip string) (*Account, error)
+	RegisterAccountWithLoginKey(ip string, loginKey string) (*Account, error)
+	GetAccountByLoginKey(key string) (*Account, error)
+	LoginAccount(a *Account) error
+
+	RegisterUser(loginKey string) (*User, error)
+	GetUserList(loginKey string) ([]*User, error)
+	GetUser(userID string) (*User, error)
+	LoginUser(user *User) error
+	UpdateUser(user *User) error
+
+	AddBattleRecord(battleRecord *BattleRecord) error
+	UpdateBattleRecord(battle *BattleRecord) error
+	GetBattleRecordUser(battleCode string, userID string) (*BattleRecord, error)
+	// CalculateUserTotalBattleCount aggregates the hot battle_record
+	// table, plus the retention archive when includeArchive is set.
+	CalculateUserTotalBattleCount(userID string, side byte, includeArchive bool) (BattleCountResult, error)
+	CalculateUserDailyBattleCount(userID string) (BattleCountResult, error)
+	// PruneBattleRecords moves every battle_record row created before
+	// the given time into the retention archive table. It's meant to be
+	// driven by a BattleRecordRetention sweeper, but is also safe to call
+	// directly as a manual admin action.
+	PruneBattleRecords(before time.Time) error
+
+	GetWinCountRanking(side byte) ([]*RankingRecord, error)
+	GetKillCountRanking(side byte) ([]*RankingRecord, error)
+	// RefreshRanking recomputes the (metric, side) ranking from scratch,
+	// persists it to ranking_snapshot and swaps it into the cache. It's
+	// meant to be driven by a RankingRefresher rather than called on
+	// every read.
+	RefreshRanking(metric string, side byte) error
+
+	// GetDailyWinCountRanking returns the top 100 by win count for date
+	// (YYYY-MM-DD, UTC). date == GetDailySeedForToday() serves a live
+	// ranking; any earlier date is read from the daily_ranking archive.
+	GetDailyWinCountRanking(date string) ([]*RankingRecord, error)
+	// GetDailySeedForToday returns the date key identifying the current,
+	// not-yet-reset daily ranking cycle.
+	GetDailySeedForToday() (string, error)
+	// ResetPeriodicRanking archives the user table's daily_* columns into
+	// daily_ranking under period (only "daily" is meaningful today - see
+	// PeriodicRankingReset) at the given time and zeroes them. It's meant
+	// to be driven by a PeriodicRankingReset rather than called directly.
+	ResetPeriodicRanking(period string, at time.Time) error
+
+	CreateTeam(tag, name, leaderUserID string) (*Team, error)
+	JoinTeam(teamID, userID string) error
+	LeaveTeam(teamID, userID string) error
+	GetTeamByTag(tag string) (*Team, error)
+	GetTeamRoster(teamID string) ([]*User, error)
+	GetTeamWinCountRanking() ([]*TeamRankingRecord, error)
+}
+
+// Config selects and configures a storage backend.
+type Config struct {
+	// Type is the backend driver: "sqlite" (default) or "postgres".
+	Type string
+	// Conn is the driver-specific connection string (a file path for
+	// sqlite, a libpq DSN/URL for postgres).
+	Conn string
+	// BcryptCost is the work factor for hashing login keys. 0 uses
+	// bcrypt.DefaultCost.
+	BcryptCost int
+}
+
+var (
+	flagSQLType    = flag.String("sql", "sqlite", "sql backend to use: sqlite or postgres")
+	flagConn       = flag.String("conn", "zdxsv.db", "database connection string for -sql")
+	flagBcryptCost = flag.Int("bcrypt-cost", 0, "bcrypt cost for hashing login keys (0 = bcrypt.DefaultCost)")
+)
+
+// NewFromFlags builds a DB from the -sql/-conn/-bcrypt-cost command-line
+// flags.
+func NewFromFlags() (DB, error) {
+	return New(Config{Type: *flagSQLType, Conn: *flagConn, BcryptCost: *flagBcryptCost})
+}
+
+// New opens the backend named by cfg.Type.
+func New(cfg Config) (DB, error) {
+	if cfg.BcryptCost > 0 {
+		BcryptCost = cfg.BcryptCost
+	}
+	switch cfg.Type {
+	case "", "sqlite":
+		return OpenSQLite(cfg.Conn)
+	case "postgres":
+		return OpenPostgres(cfg.Conn)
+	default:
+		return nil, fmt.Errorf("db: unknown backend %q", cfg.Type)
+	}
+}
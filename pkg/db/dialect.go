@@ -0,0 +1,107 @@
+package db
+
+import (
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// rankingTargetColumn returns the user-table column a ranking metric/side
+// pair orders by, e.g. ("win", 1) -> "aeug_win_count".
+func rankingTargetColumn(metric string, side byte) (string, error) {
+	var base string
+	switch metric {
+	case "win":
+		base = "win_count"
+	case "kill":
+		base = "kill_count"
+	default:
+		return "", fmt.Errorf("db: unknown ranking metric %q", metric)
+	}
+	switch side {
+	case 1:
+		return "aeug_" + base, nil
+	case 2:
+		return "titans_" + base, nil
+	default:
+		return base, nil
+	}
+}
+
+// dialect hides the query-syntax differences between backends so
+// SQLiteDB and PostgresDB can share the same query-building code. Schema
+// DDL itself lives in the migrations package, not here - see
+// db/migrations.
+type dialect interface {
+	// sumAgg wraps expr in the backend's "sum, treating NULL as 0" idiom:
+	// SQLite's TOTAL() vs standard SQL's COALESCE(SUM(),0).
+	sumAgg(expr string) string
+	// rankQuery builds the ranked top-N query against the user table for
+	// the given ORDER BY target column.
+	rankQuery(target string) string
+	// userTable returns how to reference the user table in a raw query:
+	// unquoted for sqlite, quoted for postgres since "user" is reserved
+	// there.
+	userTable() string
+}
+
+type sqliteDialect struct{}
+
+func (sqliteDialect) sumAgg(expr string) string {
+	return "TOTAL(" + expr + ")"
+}
+
+func (sqliteDialect) userTable() string { return "user" }
+
+func (sqliteDialect) rankQuery(target string) string {
+	return `
+		SELECT RANK() OVER(ORDER BY ` + target + ` DESC) as rank,
+		user_id, name, team,
+		battle_count, win_count, lose_count, kill_count, death_count,
+		aeug_battle_count, aeug_win_count, aeug_lose_count, aeug_kill_count, aeug_death_count,
+		titans_battle_count, titans_win_count, titans_lose_count, titans_kill_count, titans_death_count
+		FROM user ORDER BY rank LIMIT ?`
+}
+
+// postgresDialect mirrors sqliteDialect for a standard-SQL backend. It
+// keeps `?` bindvars in its query text like the sqlite dialect does;
+// PostgresDB rewrites them to `$n` at call time via sqlx.DB.Rebind, so
+// the dialect itself doesn't need to know about positional parameters.
+type postgresDialect struct{}
+
+func (postgresDialect) sumAgg(expr string) string {
+	return "COALESCE(SUM(" + expr + "),0)"
+}
+
+func (postgresDialect) userTable() string { return `"user"` }
+
+func (postgresDialect) rankQuery(target string) string {
+	return `
+		SELECT RANK() OVER(ORDER BY ` + target + ` DESC) as rank,
+		user_id, name, team,
+		battle_count, win_count, lose_count, kill_count, death_count,
+		aeug_battle_count, aeug_win_count, aeug_lose_count, aeug_kill_count, aeug_death_count,
+		titans_battle_count, titans_win_count, titans_lose_count, titans_kill_count, titans_death_count
+		FROM "user" ORDER BY rank LIMIT ?`
+}
+
+// scanRankingRows drains rows into RankingRecords, sanitizing names/teams
+// that aren't valid UTF-8 the same way both backends' ranking queries do.
+func scanRankingRows(rows *sqlx.Rows) ([]*RankingRecord, error) {
+	ranking := []*RankingRecord{}
+	for rows.Next() {
+		u := new(RankingRecord)
+		if err := rows.StructScan(u); err != nil {
+			return nil, err
+		}
+		if !utf8.ValidString(u.Name) {
+			u.Name = "？"
+		}
+		if !utf8.ValidString(u.Team) {
+			u.Team = "？"
+		}
+		ranking = append(ranking, u)
+	}
+	return ranking, nil
+}
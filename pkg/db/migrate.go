@@ -0,0 +1,203 @@
+package db
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+
+	"github.com/carl0sjt/zdxsv/pkg/db/migrations"
+)
+
+// schemaMigrationsDDL creates the bookkeeping tables runMigrations needs:
+// schema_migrations tracks which versions have been applied, and
+// schema_migrations_lock is a single-row mutex so two lobby processes
+// racing on startup can't apply the same migration twice. locked_at is a
+// lease timestamp: acquireMigrationLock lets a new process steal the
+// lock once it's older than migrationLockLease, so a process killed
+// mid-migration doesn't wedge every future Init() forever.
+const schemaMigrationsDDL = `
+CREATE TABLE IF NOT EXISTS schema_migrations (
+	version integer,
+	applied_at timestamp,
+	PRIMARY KEY (version)
+);
+CREATE TABLE IF NOT EXISTS schema_migrations_lock (
+	id integer,
+	locked integer default 0,
+	locked_at timestamp,
+	PRIMARY KEY (id)
+);
+`
+
+// migrationLockLease is how long acquireMigrationLock waits before
+// treating a held lock as abandoned and stealing it. Migrations run in
+// a handful of short transactions, so this comfortably covers a slow
+// one without letting a crashed holder block startup indefinitely.
+const migrationLockLease = 5 * time.Minute
+
+// runMigrations applies every pending migration from the migrations
+// package, in a single transaction per step, and records the version in
+// schema_migrations as it goes. When dryRun is true it only logs the SQL
+// that would run and applies none of it; the schema_migrations
+// bookkeeping tables and lock row are still created if missing. It returns the
+// versions it applied (or, in dry-run mode, would apply).
+func runMigrations(sdb *sqlx.DB, dryRun bool) ([]int, error) {
+	if _, err := sdb.Exec(schemaMigrationsDDL); err != nil {
+		return nil, errors.Wrap(err, "failed to create schema_migrations")
+	}
+	// Seed the lock row; a racing process hitting a duplicate key here is
+	// expected and fine, so the error is intentionally ignored.
+	sdb.Exec(`INSERT INTO schema_migrations_lock (id, locked) VALUES (1, 0)`)
+
+	if !dryRun {
+		locked, err := acquireMigrationLock(sdb)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to acquire migration lock")
+		}
+		if !locked {
+			return nil, errors.New("another process is already running migrations")
+		}
+		defer releaseMigrationLock(sdb)
+	}
+
+	all, err := migrations.All()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load migrations")
+	}
+
+	var appliedVersions []int
+	if err := sdb.Select(&appliedVersions, `SELECT version FROM schema_migrations ORDER BY version`); err != nil {
+		return nil, errors.Wrap(err, "failed to read schema_migrations")
+	}
+	already := map[int]bool{}
+	for _, v := range appliedVersions {
+		already[v] = true
+	}
+
+	applied := []int{}
+	for _, m := range all {
+		if already[m.Version] {
+			continue
+		}
+
+		if dryRun {
+			log.Printf("db: migration %04d_%s (dry run):\n%s", m.Version, m.Name, m.Up)
+			applied = append(applied, m.Version)
+			continue
+		}
+
+		tx, err := sdb.Beginx()
+		if err != nil {
+			return applied, errors.Wrap(err, "Begin failed")
+		}
+		if _, err := tx.Exec(m.Up); err != nil {
+			tx.Rollback()
+			return applied, errors.Wrapf(err, "migration %04d_%s failed", m.Version, m.Name)
+		}
+		if _, err := tx.Exec(tx.Rebind(`INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`), m.Version, time.Now()); err != nil {
+			tx.Rollback()
+			return applied, errors.Wrapf(err, "failed to record migration %04d_%s", m.Version, m.Name)
+		}
+		if err := tx.Commit(); err != nil {
+			return applied, errors.Wrapf(err, "failed to commit migration %04d_%s", m.Version, m.Name)
+		}
+
+		log.Printf("db: applied migration %04d_%s", m.Version, m.Name)
+		applied = append(applied, m.Version)
+	}
+
+	return applied, nil
+}
+
+// runMigrationsDown rolls back up to steps applied migrations (all of
+// them if steps <= 0) in descending version order, running each
+// migration's Down script and removing its schema_migrations row. It
+// takes the same lock as runMigrations so a rollback can't race an
+// Init() applying new migrations concurrently. It returns the versions
+// it rolled back.
+func runMigrationsDown(sdb *sqlx.DB, steps int) ([]int, error) {
+	if _, err := sdb.Exec(schemaMigrationsDDL); err != nil {
+		return nil, errors.Wrap(err, "failed to create schema_migrations")
+	}
+	sdb.Exec(`INSERT INTO schema_migrations_lock (id, locked) VALUES (1, 0)`)
+
+	locked, err := acquireMigrationLock(sdb)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to acquire migration lock")
+	}
+	if !locked {
+		return nil, errors.New("another process is already running migrations")
+	}
+	defer releaseMigrationLock(sdb)
+
+	all, err := migrations.All()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load migrations")
+	}
+	byVersion := map[int]migrations.Migration{}
+	for _, m := range all {
+		byVersion[m.Version] = m
+	}
+
+	var appliedVersions []int
+	if err := sdb.Select(&appliedVersions, `SELECT version FROM schema_migrations ORDER BY version DESC`); err != nil {
+		return nil, errors.Wrap(err, "failed to read schema_migrations")
+	}
+	if steps > 0 && steps < len(appliedVersions) {
+		appliedVersions = appliedVersions[:steps]
+	}
+
+	rolledBack := []int{}
+	for _, v := range appliedVersions {
+		m, ok := byVersion[v]
+		if !ok {
+			return rolledBack, fmt.Errorf("migrations: no source found for applied version %d", v)
+		}
+
+		tx, err := sdb.Beginx()
+		if err != nil {
+			return rolledBack, errors.Wrap(err, "Begin failed")
+		}
+		if _, err := tx.Exec(m.Down); err != nil {
+			tx.Rollback()
+			return rolledBack, errors.Wrapf(err, "rollback of migration %04d_%s failed", m.Version, m.Name)
+		}
+		if _, err := tx.Exec(tx.Rebind(`DELETE FROM schema_migrations WHERE version = ?`), m.Version); err != nil {
+			tx.Rollback()
+			return rolledBack, errors.Wrapf(err, "failed to unrecord migration %04d_%s", m.Version, m.Name)
+		}
+		if err := tx.Commit(); err != nil {
+			return rolledBack, errors.Wrapf(err, "failed to commit rollback of migration %04d_%s", m.Version, m.Name)
+		}
+
+		log.Printf("db: rolled back migration %04d_%s", m.Version, m.Name)
+		rolledBack = append(rolledBack, m.Version)
+	}
+
+	return rolledBack, nil
+}
+
+// acquireMigrationLock claims the single lock row, either because it's
+// free or because its lease expired (the previous holder was killed
+// mid-migration and never released it).
+func acquireMigrationLock(sdb *sqlx.DB) (bool, error) {
+	res, err := sdb.Exec(sdb.Rebind(`
+UPDATE schema_migrations_lock SET locked = 1, locked_at = ?
+WHERE id = 1 AND (locked = 0 OR locked_at < ?)`), time.Now(), time.Now().Add(-migrationLockLease))
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+func releaseMigrationLock(sdb *sqlx.DB) error {
+	_, err := sdb.Exec(`UPDATE schema_migrations_lock SET locked = 0 WHERE id = 1`)
+	return err
+}
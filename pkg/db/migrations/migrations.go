@@ -0,0 +1,82 @@
+// Package migrations holds the numbered, versioned SQL migrations applied
+// to the lobby's schema. Each version is a pair of embedded files:
+// NNNN_name.sql (up) and NNNN_name.down.sql (down). db.Init loads them in
+// ascending version order and applies whichever are pending.
+package migrations
+
+import (
+	"embed"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//go:embed *.sql
+var files embed.FS
+
+// Migration is one versioned schema change.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// All returns every migration in ascending version order.
+func All() ([]Migration, error) {
+	entries, err := files.ReadDir(".")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*Migration{}
+	for _, e := range entries {
+		name := e.Name()
+		down := strings.HasSuffix(name, ".down.sql")
+		if !down && !strings.HasSuffix(name, ".sql") {
+			continue
+		}
+
+		version, label, err := parseName(name)
+		if err != nil {
+			return nil, err
+		}
+
+		content, err := files.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: label}
+			byVersion[version] = m
+		}
+		if down {
+			m.Down = string(content)
+		} else {
+			m.Up = string(content)
+		}
+	}
+
+	out := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		out = append(out, *m)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Version < out[j].Version })
+	return out, nil
+}
+
+func parseName(fileName string) (int, string, error) {
+	base := strings.TrimSuffix(strings.TrimSuffix(fileName, ".down.sql"), ".sql")
+	parts := strings.SplitN(base, "_", 2)
+	if len(parts) != 2 {
+		return 0, "", fmt.Errorf("migrations: malformed file name %q", fileName)
+	}
+	version, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, "", fmt.Errorf("migrations: malformed version in %q: %w", fileName, err)
+	}
+	return version, parts[1], nil
+}
@@ -0,0 +1,58 @@
+package db
+
+import (
+	"log"
+	"time"
+)
+
+// PeriodicRankingReset runs ResetPeriodicRanking on a timer, archiving and
+// zeroing the user table's daily_* columns once per cycle.
+// NewDailyRankingReset wires it up with DefaultDailyRankingReset, the
+// only cycle currently supported: the user table only ever tracks one
+// set of daily_* counters, so a second job with a longer cfg.Interval
+// (e.g. for a weekly or seasonal leaderboard) would zero those same
+// columns every night and never accumulate a full week's worth of data.
+// A real weekly/seasonal leaderboard needs its own counters before this
+// type can safely run more than one cycle.
+type PeriodicRankingReset struct {
+	db  DB
+	cfg RankingResetConfig
+
+	stop chan struct{}
+}
+
+// NewDailyRankingReset builds a PeriodicRankingReset using
+// DefaultDailyRankingReset, firing once every UTC midnight.
+func NewDailyRankingReset(db DB) *PeriodicRankingReset {
+	return newPeriodicRankingReset(db, DefaultDailyRankingReset)
+}
+
+func newPeriodicRankingReset(db DB, cfg RankingResetConfig) *PeriodicRankingReset {
+	return &PeriodicRankingReset{db: db, cfg: cfg, stop: make(chan struct{})}
+}
+
+// Start blocks until the next UTC midnight, resets, then repeats every
+// cfg.Interval until Stop is called. Run it in its own goroutine.
+func (r *PeriodicRankingReset) Start() {
+	now := time.Now().UTC()
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC).Add(24 * time.Hour)
+
+	timer := time.NewTimer(midnight.Sub(now))
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			if err := r.db.ResetPeriodicRanking(r.cfg.Period, time.Now()); err != nil {
+				log.Printf("db: %s ranking reset failed: %v", r.cfg.Period, err)
+			}
+			timer.Reset(r.cfg.Interval)
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// Stop ends the loop started by Start.
+func (r *PeriodicRankingReset) Stop() {
+	close(r.stop)
+}
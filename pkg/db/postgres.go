@@ -0,0 +1,196 @@
+package db
+
+import (
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+var postgresD = postgresDialect{}
+
+// PostgresDB is the lib/pq-backed implementation of DB, for clustered
+// deployments where several lobby processes share one database. It uses
+// the same `?`-bindvar query text as SQLiteDB and rewrites it to `$n`
+// via sqlx.DB.Rebind before each call.
+type PostgresDB struct {
+	*sqlx.DB
+	*SQLiteCache
+}
+
+// Pool tuning for the shared database clustered deployments connect to:
+// several lobby processes hit the same Postgres, so each one caps its
+// own pool rather than letting database/sql grow it unbounded, and
+// recycles connections periodically so a failed-over or restarted
+// Postgres gets picked up without restarting every lobby process.
+const (
+	postgresMaxOpenConns    = 20
+	postgresMaxIdleConns    = 5
+	postgresConnMaxLifetime = 30 * time.Minute
+)
+
+// OpenPostgres connects to conn (a libpq connection string or URL) and
+// returns a PostgresDB ready for Init.
+func OpenPostgres(conn string) (*PostgresDB, error) {
+	sdb, err := sqlx.Connect("postgres", conn)
+	if err != nil {
+		return nil, errors.Wrap(err, "sqlx.Connect failed")
+	}
+	sdb.SetMaxOpenConns(postgresMaxOpenConns)
+	sdb.SetMaxIdleConns(postgresMaxIdleConns)
+	sdb.SetConnMaxLifetime(postgresConnMaxLifetime)
+
+	if err := sdb.Ping(); err != nil {
+		sdb.Close()
+		return nil, errors.Wrap(err, "Ping failed")
+	}
+
+	return &PostgresDB{DB: sdb, SQLiteCache: NewSQLiteCache()}, nil
+}
+
+// Init applies any pending migrations from the migrations package,
+// creating the schema from scratch on a fresh database.
+func (db PostgresDB) Init() error {
+	_, err := runMigrations(db.DB, false)
+	return err
+}
+
+// Migrate is a thin wrapper kept for operators' existing tooling; it now
+// just runs the same versioned migrations as Init. Use MigrateDryRun to
+// preview pending SQL without applying it.
+func (db PostgresDB) Migrate() error {
+	_, err := runMigrations(db.DB, false)
+	return err
+}
+
+// MigrateDryRun logs the SQL of every pending migration without applying
+// any of it.
+func (db PostgresDB) MigrateDryRun() error {
+	_, err := runMigrations(db.DB, true)
+	return err
+}
+
+// MigrateDown rolls back up to steps applied migrations (all of them if
+// steps <= 0) by running their Down scripts in descending version
+// order. It's an operator escape hatch, not part of the regular
+// Init/Migrate path.
+func (db PostgresDB) MigrateDown(steps int) error {
+	_, err := runMigrationsDown(db.DB, steps)
+	return err
+}
+
+func (db PostgresDB) RegisterAccount(ip string) (*Account, error) {
+	return registerAccount(db.DB, ip, genLoginKey())
+}
+
+func (db PostgresDB) RegisterAccountWithLoginKey(ip string, loginKey string) (*Account, error) {
+	return registerAccount(db.DB, ip, loginKey)
+}
+
+func (db PostgresDB) GetAccountByLoginKey(key string) (*Account, error) {
+	return getAccountByLoginKey(db.DB, key)
+}
+
+func (db PostgresDB) LoginAccount(a *Account) error {
+	return loginAccount(db.DB, a)
+}
+
+func (db PostgresDB) RegisterUser(loginKey string) (*User, error) {
+	return registerUser(db.DB, postgresD, loginKey)
+}
+
+func (db PostgresDB) GetUserList(loginKey string) ([]*User, error) {
+	return getUserList(db.DB, postgresD, loginKey)
+}
+
+func (db PostgresDB) GetUser(userID string) (*User, error) {
+	return getUser(db.DB, postgresD, userID)
+}
+
+func (db PostgresDB) LoginUser(user *User) error {
+	return loginUser(db.DB, postgresD, user)
+}
+
+func (db PostgresDB) UpdateUser(user *User) error {
+	return updateUser(db.DB, postgresD, user)
+}
+
+func (db PostgresDB) AddBattleRecord(battleRecord *BattleRecord) error {
+	return addBattleRecord(db.DB, battleRecord)
+}
+
+func (db PostgresDB) UpdateBattleRecord(battle *BattleRecord) error {
+	return updateBattleRecord(db.DB, db.SQLiteCache, battle)
+}
+
+func (db PostgresDB) GetBattleRecordUser(battleCode string, userID string) (*BattleRecord, error) {
+	return getBattleRecordUser(db.DB, battleCode, userID)
+}
+
+func (db PostgresDB) CalculateUserTotalBattleCount(userID string, side byte, includeArchive bool) (BattleCountResult, error) {
+	return calculateUserTotalBattleCount(db.DB, postgresD, userID, side, includeArchive)
+}
+
+func (db PostgresDB) CalculateUserDailyBattleCount(userID string) (BattleCountResult, error) {
+	return calculateUserDailyBattleCount(db.DB, postgresD, userID)
+}
+
+// PruneBattleRecords moves every battle_record row older than before into
+// DefaultBattleRecordRetention.ArchiveTable.
+func (db PostgresDB) PruneBattleRecords(before time.Time) error {
+	_, err := pruneBattleRecords(db.DB, DefaultBattleRecordRetention.ArchiveTable, before)
+	return err
+}
+
+func (db PostgresDB) GetWinCountRanking(side byte) ([]*RankingRecord, error) {
+	return getWinCountRanking(db.DB, db.SQLiteCache, postgresD, side)
+}
+
+func (db PostgresDB) GetKillCountRanking(side byte) ([]*RankingRecord, error) {
+	return getKillCountRanking(db.DB, db.SQLiteCache, postgresD, side)
+}
+
+// RefreshRanking recomputes the (metric, side) ranking with a full
+// RANK() OVER scan, persists it to ranking_snapshot and swaps it into
+// the cache. RankingRefresher calls this on a timer; GetWinCountRanking
+// and GetKillCountRanking only fall back to it on a cold cache.
+func (db PostgresDB) RefreshRanking(metric string, side byte) error {
+	return refreshRanking(db.DB, db.SQLiteCache, postgresD, metric, side)
+}
+
+func (db PostgresDB) CreateTeam(tag, name, leaderUserID string) (*Team, error) {
+	return createTeam(db.DB, tag, name, leaderUserID)
+}
+
+func (db PostgresDB) JoinTeam(teamID, userID string) error {
+	return joinTeam(db.DB, postgresD, teamID, userID)
+}
+
+func (db PostgresDB) LeaveTeam(teamID, userID string) error {
+	return leaveTeam(db.DB, postgresD, teamID, userID)
+}
+
+func (db PostgresDB) GetTeamByTag(tag string) (*Team, error) {
+	return getTeamByTag(db.DB, tag)
+}
+
+func (db PostgresDB) GetTeamRoster(teamID string) ([]*User, error) {
+	return getTeamRoster(db.DB, postgresD, teamID)
+}
+
+func (db PostgresDB) GetTeamWinCountRanking() ([]*TeamRankingRecord, error) {
+	return getTeamWinCountRanking(db.DB, postgresD)
+}
+
+func (db PostgresDB) GetDailyWinCountRanking(date string) ([]*RankingRecord, error) {
+	return queryPeriodicRanking(db.DB, postgresD, "daily", date)
+}
+
+func (db PostgresDB) GetDailySeedForToday() (string, error) {
+	return getDailySeedForToday(), nil
+}
+
+func (db PostgresDB) ResetPeriodicRanking(period string, at time.Time) error {
+	return resetPeriodicRanking(db.DB, postgresD, period, at)
+}
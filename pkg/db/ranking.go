@@ -0,0 +1,153 @@
+package db
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// staleRankingWarnThreshold is how long a ranking can sit stale before
+// refreshRanking logs a warning instead of silently recomputing it.
+// RankingRefresher recomputes every ranking on DefaultRankingRefreshInterval,
+// so anything stale much longer than that means the refresher isn't
+// keeping up (or isn't running at all).
+const staleRankingWarnThreshold = 2 * DefaultRankingRefreshInterval
+
+// getRanking returns the cached ranking for key, if any, regardless of
+// whether it has been marked stale — readers always see a consistent
+// snapshot rather than blocking on a recompute.
+func (c *SQLiteCache) getRanking(key string) ([]*RankingRecord, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	r, ok := c.rankingCache[key]
+	return r, ok
+}
+
+// setRanking atomically swaps in a freshly computed ranking and clears
+// its stale mark.
+func (c *SQLiteCache) setRanking(key string, ranking []*RankingRecord) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.rankingCache[key] = ranking
+	delete(c.stale, key)
+}
+
+// markRankingStale flags every cached ranking as stale without clearing
+// it, so a battle update doesn't force the next reader into a synchronous
+// RANK() OVER scan; RankingRefresher is what actually recomputes it. A
+// ranking already marked stale keeps its original stale time, so repeated
+// battle updates before the next refresh don't reset the clock
+// staleSince reports.
+func (c *SQLiteCache) markRankingStale() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	now := time.Now()
+	for key := range c.rankingCache {
+		if _, ok := c.stale[key]; !ok {
+			c.stale[key] = now
+		}
+	}
+}
+
+// staleSince reports when key was first marked stale, if it still is.
+func (c *SQLiteCache) staleSince(key string) (time.Time, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	t, ok := c.stale[key]
+	return t, ok
+}
+
+// persistRankingSnapshot replaces the ranking_snapshot rows for
+// (metric, side) with ranking, inside a single transaction, so the
+// RankingRefresher's output survives a restart.
+func persistRankingSnapshot(sdb *sqlx.DB, metric string, side byte, ranking []*RankingRecord) error {
+	tx, err := sdb.Beginx()
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(sdb.Rebind(`DELETE FROM ranking_snapshot WHERE metric = ? AND side = ?`), metric, side); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	now := time.Now()
+	insertSQL := sdb.Rebind(`
+INSERT INTO ranking_snapshot
+	(metric, side, rank, user_id, name, team, battle_count, win_count, lose_count, kill_count, death_count, updated)
+VALUES
+	(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	for i, r := range ranking {
+		_, err := tx.Exec(insertSQL,
+			metric, side, i+1, r.UserID, r.Name, r.Team,
+			r.BattleCount, r.WinCount, r.LoseCount, r.KillCount, r.DeathCount, now)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func getWinCountRanking(sdb *sqlx.DB, cache *SQLiteCache, dlc dialect, side byte) ([]*RankingRecord, error) {
+	return getCachedRanking(sdb, cache, dlc, "win", side)
+}
+
+func getKillCountRanking(sdb *sqlx.DB, cache *SQLiteCache, dlc dialect, side byte) ([]*RankingRecord, error) {
+	return getCachedRanking(sdb, cache, dlc, "kill", side)
+}
+
+// getCachedRanking returns the cached (metric, side) ranking, falling
+// back to a synchronous refreshRanking on a cold cache; RankingRefresher
+// normally keeps the cache warm on its own schedule so this fallback is
+// rare.
+func getCachedRanking(sdb *sqlx.DB, cache *SQLiteCache, dlc dialect, metric string, side byte) ([]*RankingRecord, error) {
+	key := fmt.Sprint(metric, side)
+	if ranking, ok := cache.getRanking(key); ok {
+		return ranking, nil
+	}
+	if err := refreshRanking(sdb, cache, dlc, metric, side); err != nil {
+		return nil, err
+	}
+	ranking, _ := cache.getRanking(key)
+	return ranking, nil
+}
+
+// refreshRanking recomputes the (metric, side) ranking with a full
+// RANK() OVER scan, persists it to ranking_snapshot and swaps it into
+// the cache. RankingRefresher calls this on a timer; getWinCountRanking
+// and getKillCountRanking only fall back to it on a cold cache.
+func refreshRanking(sdb *sqlx.DB, cache *SQLiteCache, dlc dialect, metric string, side byte) error {
+	key := fmt.Sprint(metric, side)
+	if since, ok := cache.staleSince(key); ok {
+		if age := time.Since(since); age > staleRankingWarnThreshold {
+			log.Printf("db: ranking %s sat stale for %s before refresh", key, age)
+		}
+	}
+
+	target, err := rankingTargetColumn(metric, side)
+	if err != nil {
+		return err
+	}
+
+	rows, err := sdb.Queryx(sdb.Rebind(dlc.rankQuery(target)), 100)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	ranking, err := scanRankingRows(rows)
+	if err != nil {
+		return err
+	}
+
+	if err := persistRankingSnapshot(sdb, metric, side, ranking); err != nil {
+		return err
+	}
+
+	cache.setRanking(key, ranking)
+	return nil
+}
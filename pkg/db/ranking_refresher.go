@@ -0,0 +1,71 @@
+package db
+
+import (
+	"log"
+	"time"
+)
+
+// DefaultRankingRefreshInterval is how often a RankingRefresher
+// recomputes rankings when no interval is configured.
+const DefaultRankingRefreshInterval = 5 * time.Minute
+
+// rankingKey identifies one (metric, side) ranking refreshed on a timer
+// and cached under the matching GetWinCountRanking/GetKillCountRanking
+// key.
+type rankingKey struct {
+	metric string // "win" or "kill"
+	side   byte
+}
+
+var rankingKeys = []rankingKey{
+	{"win", 0}, {"win", 1}, {"win", 2},
+	{"kill", 0}, {"kill", 1}, {"kill", 2},
+}
+
+// RankingRefresher periodically recomputes every (metric, side) ranking
+// and swaps the result into the backend's cache via RefreshRanking, so
+// UpdateBattleRecord marking the cache stale never has to pay for a
+// synchronous RANK() OVER scan itself.
+type RankingRefresher struct {
+	db       DB
+	interval time.Duration
+	stop     chan struct{}
+}
+
+// NewRankingRefresher builds a refresher for db. interval <= 0 uses
+// DefaultRankingRefreshInterval.
+func NewRankingRefresher(db DB, interval time.Duration) *RankingRefresher {
+	if interval <= 0 {
+		interval = DefaultRankingRefreshInterval
+	}
+	return &RankingRefresher{db: db, interval: interval, stop: make(chan struct{})}
+}
+
+// Start refreshes every ranking once, then again on every tick of the
+// configured interval, until Stop is called. Run it in its own goroutine.
+func (r *RankingRefresher) Start() {
+	r.refreshAll()
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.refreshAll()
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// Stop ends the loop started by Start.
+func (r *RankingRefresher) Stop() {
+	close(r.stop)
+}
+
+func (r *RankingRefresher) refreshAll() {
+	for _, k := range rankingKeys {
+		if err := r.db.RefreshRanking(k.metric, k.side); err != nil {
+			log.Printf("db: ranking refresh for metric=%s side=%d failed: %v", k.metric, k.side, err)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package db
+
+import (
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// battleRecordArchiveBatchSize caps how many rows pruneBattleRecords moves
+// per transaction, so a large backlog doesn't hold one long-running
+// transaction against the hot battle_record table.
+const battleRecordArchiveBatchSize = 1000
+
+// RetentionPolicy configures the BattleRecordRetention sweeper.
+type RetentionPolicy struct {
+	// MaxAge is how long a battle_record row stays in the hot table
+	// before it's eligible to move to ArchiveTable.
+	MaxAge time.Duration
+	// ArchiveTable is the destination table, normally
+	// "battle_record_archive". PruneBattleRecords and
+	// CalculateUserTotalBattleCount only read it from
+	// DefaultBattleRecordRetention, not from a sweeper's own policy.
+	ArchiveTable string
+	// CheckInterval is how often the sweeper looks for rows to archive.
+	CheckInterval time.Duration
+}
+
+// DefaultBattleRecordRetention archives battle_record rows older than 90
+// days into battle_record_archive once an hour.
+var DefaultBattleRecordRetention = RetentionPolicy{
+	MaxAge:        90 * 24 * time.Hour,
+	ArchiveTable:  "battle_record_archive",
+	CheckInterval: time.Hour,
+}
+
+// pruneBattleRecords moves every battle_record row with created < before
+// into archiveTable, batchSize rows per transaction, and returns the
+// number of rows moved.
+func pruneBattleRecords(sdb *sqlx.DB, archiveTable string, before time.Time) (int, error) {
+	moved := 0
+	for {
+		n, err := pruneBattleRecordBatch(sdb, archiveTable, before, battleRecordArchiveBatchSize)
+		if err != nil {
+			return moved, err
+		}
+		moved += n
+		if n < battleRecordArchiveBatchSize {
+			return moved, nil
+		}
+	}
+}
+
+func pruneBattleRecordBatch(sdb *sqlx.DB, archiveTable string, before time.Time, batchSize int) (int, error) {
+	tx, err := sdb.Beginx()
+	if err != nil {
+		return 0, err
+	}
+
+	var codes [][2]string
+	rows, err := tx.Queryx(tx.Rebind(`SELECT battle_code, user_id FROM battle_record WHERE created < ? LIMIT ?`), before, batchSize)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	for rows.Next() {
+		var battleCode, userID string
+		if err := rows.Scan(&battleCode, &userID); err != nil {
+			rows.Close()
+			tx.Rollback()
+			return 0, err
+		}
+		codes = append(codes, [2]string{battleCode, userID})
+	}
+	rows.Close()
+
+	if len(codes) == 0 {
+		tx.Rollback()
+		return 0, nil
+	}
+
+	insertArchive := tx.Rebind(`
+INSERT INTO ` + archiveTable + `
+	SELECT * FROM battle_record WHERE battle_code = ? AND user_id = ?`)
+	deleteHot := tx.Rebind(`DELETE FROM battle_record WHERE battle_code = ? AND user_id = ?`)
+	for _, c := range codes {
+		if _, err := tx.Exec(insertArchive, c[0], c[1]); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		if _, err := tx.Exec(deleteHot, c[0], c[1]); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return len(codes), nil
+}
+
+// battleRecordSource returns the FROM-clause table expression
+// CalculateUserTotalBattleCount should aggregate over: just the hot table,
+// or a union with archiveTable when includeArchive is set.
+func battleRecordSource(archiveTable string, includeArchive bool) string {
+	if !includeArchive {
+		return "battle_record"
+	}
+	return "(SELECT * FROM battle_record UNION ALL SELECT * FROM " + archiveTable + ") battle_record"
+}
@@ -0,0 +1,165 @@
+package db
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Team is one row of the team table: a tagged, named group of users with
+// a single leader, joined/left via JoinTeam/LeaveTeam and ranked together
+// by GetTeamWinCountRanking.
+type Team struct {
+	TeamID       string    `db:"team_id"`
+	Tag          string    `db:"tag"`
+	Name         string    `db:"name"`
+	Created      time.Time `db:"created"`
+	LeaderUserID string    `db:"leader_user_id"`
+	System       int       `db:"system"`
+}
+
+// TeamRankingRecord is one row of GetTeamWinCountRanking: a team's
+// aggregate record across every member's battle_record rows.
+type TeamRankingRecord struct {
+	Rank    int    `db:"rank"`
+	TeamID  string `db:"team_id"`
+	Tag     string `db:"tag"`
+	Name    string `db:"name"`
+	WinSum  int64  `db:"win_sum"`
+	LoseSum int64  `db:"lose_sum"`
+	KillSum int64  `db:"kill_sum"`
+}
+
+// genTeamID returns a random identifier for a new team, the same way
+// genLoginKey/genUserID generate theirs elsewhere in this package.
+func genTeamID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic("db: failed to read random bytes: " + err.Error())
+	}
+	return hex.EncodeToString(b)
+}
+
+func createTeam(sdb *sqlx.DB, tag, name, leaderUserID string) (*Team, error) {
+	teamID := genTeamID()
+	now := time.Now()
+	_, err := sdb.Exec(sdb.Rebind(`
+INSERT INTO team
+	(team_id, tag, name, created, leader_user_id, system)
+VALUES
+	(?, ?, ?, ?, ?, ?)`), teamID, tag, name, now, leaderUserID, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &Team{
+		TeamID:       teamID,
+		Tag:          tag,
+		Name:         name,
+		Created:      now,
+		LeaderUserID: leaderUserID,
+	}, nil
+}
+
+// joinTeam adds userID to teamID's roster and updates user.team to the
+// team's tag, the denormalized copy existing clients still read.
+func joinTeam(sdb *sqlx.DB, dlc dialect, teamID, userID string) error {
+	tx, err := sdb.Beginx()
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(tx.Rebind(`
+INSERT INTO team_member (team_id, user_id, joined, role) VALUES (?, ?, ?, ?)`),
+		teamID, userID, time.Now(), "member"); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	team := &Team{}
+	if err := tx.Get(team, tx.Rebind(`SELECT * FROM team WHERE team_id = ?`), teamID); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if _, err := tx.Exec(tx.Rebind(`UPDATE `+dlc.userTable()+` SET team = ? WHERE user_id = ?`), team.Tag, userID); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// leaveTeam removes userID from teamID's roster and clears the
+// denormalized user.team back to empty.
+func leaveTeam(sdb *sqlx.DB, dlc dialect, teamID, userID string) error {
+	tx, err := sdb.Beginx()
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(tx.Rebind(`DELETE FROM team_member WHERE team_id = ? AND user_id = ?`), teamID, userID); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if _, err := tx.Exec(tx.Rebind(`UPDATE `+dlc.userTable()+` SET team = '' WHERE user_id = ?`), userID); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func getTeamByTag(sdb *sqlx.DB, tag string) (*Team, error) {
+	team := &Team{}
+	err := sdb.Get(team, sdb.Rebind(`SELECT * FROM team WHERE tag = ?`), tag)
+	return team, err
+}
+
+func getTeamRoster(sdb *sqlx.DB, dlc dialect, teamID string) ([]*User, error) {
+	users := []*User{}
+	err := sdb.Select(&users, sdb.Rebind(`
+		SELECT u.* FROM `+dlc.userTable()+` u
+		JOIN team_member tm ON tm.user_id = u.user_id
+		WHERE tm.team_id = ?`), teamID)
+	return users, err
+}
+
+// getTeamWinCountRanking aggregates every member's battle_record rows per
+// team and ranks by summed win count. dlc.sumAgg supplies the backend's
+// "sum, treating NULL as 0" idiom (TOTAL() vs COALESCE(SUM(),0)).
+func getTeamWinCountRanking(sdb *sqlx.DB, dlc dialect) ([]*TeamRankingRecord, error) {
+	query := `
+		SELECT t.team_id, t.tag, t.name,
+		` + dlc.sumAgg("br.win") + ` as win_sum,
+		` + dlc.sumAgg("br.lose") + ` as lose_sum,
+		` + dlc.sumAgg("br.kill") + ` as kill_sum
+		FROM team t
+		JOIN team_member tm ON tm.team_id = t.team_id
+		JOIN battle_record br ON br.user_id = tm.user_id
+		WHERE br.aggregate <> 0 AND br.players = 4
+		GROUP BY t.team_id, t.tag, t.name
+		ORDER BY win_sum DESC
+		LIMIT 100`
+
+	rows, err := sdb.Queryx(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ranking := []*TeamRankingRecord{}
+	rank := 1
+	for rows.Next() {
+		r := new(TeamRankingRecord)
+		if err := rows.StructScan(r); err != nil {
+			return nil, err
+		}
+		r.Rank = rank
+		rank++
+		ranking = append(ranking, r)
+	}
+	return ranking, nil
+}
@@ -0,0 +1,141 @@
+package db
+
+import (
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// registerAccount inserts a new account row, storing a bcrypt hash and
+// lookup prefix of key rather than the key itself. login_key is kept
+// alongside it only because the user table still joins against it
+// directly; the hash is what getAccountByLoginKey actually verifies
+// against.
+func registerAccount(sdb *sqlx.DB, ip string, key string) (*Account, error) {
+	hash, err := hashLoginKey(key)
+	if err != nil {
+		return nil, err
+	}
+	prefix := loginKeyPrefix(key)
+
+	now := time.Now()
+	_, err = sdb.Exec(sdb.Rebind(`
+INSERT INTO account
+	(login_key, login_key_hash, login_key_prefix, created_ip, created, last_login, system)
+VALUES
+	(?, ?, ?, ?, ?, ?, ?)`), key, hash, prefix, ip, now, now, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &Account{
+		LoginKey:       key,
+		LoginKeyHash:   hash,
+		LoginKeyPrefix: prefix,
+		CreatedIP:      ip,
+	}, nil
+}
+
+func loginAccount(sdb *sqlx.DB, a *Account) error {
+	a.SessionID = genSessionID()
+	a.LastLogin = time.Now()
+	_, err := sdb.Exec(sdb.Rebind(`
+UPDATE
+	account
+SET
+	session_id = ?,
+	last_login = ?
+WHERE
+	login_key = ?`),
+		a.SessionID,
+		a.LastLogin,
+		a.LoginKey)
+	return err
+}
+
+func registerUser(sdb *sqlx.DB, dlc dialect, loginKey string) (*User, error) {
+	userID := genUserID()
+	now := time.Now()
+	_, err := sdb.Exec(sdb.Rebind(`INSERT INTO `+dlc.userTable()+` (user_id, login_key, created) VALUES (?, ?, ?)`), userID, loginKey, now)
+	if err != nil {
+		return nil, err
+	}
+	return &User{
+		LoginKey: loginKey,
+		UserID:   userID,
+		Created:  now,
+	}, nil
+}
+
+func getUserList(sdb *sqlx.DB, dlc dialect, loginKey string) ([]*User, error) {
+	rows, err := sdb.Queryx(sdb.Rebind(`SELECT * FROM `+dlc.userTable()+` WHERE login_key = ?`), loginKey)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []*User{}
+	for rows.Next() {
+		u := new(User)
+		if err := rows.StructScan(u); err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, nil
+}
+
+func getUser(sdb *sqlx.DB, dlc dialect, userID string) (*User, error) {
+	u := &User{}
+	err := sdb.Get(u, sdb.Rebind(`SELECT * FROM `+dlc.userTable()+` WHERE user_id = ?`), userID)
+	return u, err
+}
+
+// loginUser updates both account.last_user_id and the user row's
+// session_id so the session tracked on the user stays in sync with the
+// account it belongs to.
+func loginUser(sdb *sqlx.DB, dlc dialect, user *User) error {
+	a, err := getAccountByLoginKey(sdb, user.LoginKey)
+	if err != nil {
+		return err
+	}
+	a.LastUserID = user.UserID
+
+	if _, err := sdb.Exec(sdb.Rebind(`UPDATE account SET last_user_id = ? WHERE login_key = ?`), a.LastUserID, a.LoginKey); err != nil {
+		return err
+	}
+
+	_, err = sdb.Exec(sdb.Rebind(`UPDATE `+dlc.userTable()+` SET session_id = ? WHERE user_id = ?`), user.SessionID, user.UserID)
+	return err
+}
+
+func updateUser(sdb *sqlx.DB, dlc dialect, user *User) error {
+	_, err := sdb.NamedExec(`
+UPDATE `+dlc.userTable()+`
+SET
+	name = :name,
+	team = :team,
+	battle_count = :battle_count,
+	win_count = :win_count,
+	lose_count = :lose_count,
+	kill_count = :kill_count,
+	death_count = :death_count,
+	aeug_battle_count = :aeug_battle_count,
+	aeug_win_count = :aeug_win_count,
+	aeug_lose_count = :aeug_lose_count,
+	aeug_kill_count = :aeug_kill_count,
+	aeug_death_count = :aeug_death_count,
+	titans_battle_count = :titans_battle_count,
+	titans_win_count = :titans_win_count,
+	titans_lose_count = :titans_lose_count,
+	titans_kill_count = :titans_kill_count,
+	titans_death_count = :titans_death_count,
+	daily_battle_count = :daily_battle_count,
+	daily_win_count = :daily_win_count,
+	daily_lose_count = :daily_lose_count,
+	daily_kill_count = :daily_kill_count,
+	daily_death_count = :daily_death_count,
+	system = :system
+WHERE
+	user_id = :user_id`, user)
+	return err
+}
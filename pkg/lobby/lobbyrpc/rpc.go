@@ -2,6 +2,7 @@ package lobbyrpc
 
 import (
 	"net"
+	"time"
 
 	"github.com/valyala/gorpc"
 )
@@ -13,6 +14,14 @@ func init() {
 	gorpc.RegisterType(new(BattleInfoResponse))
 	gorpc.RegisterType(new(StatusRequest))
 	gorpc.RegisterType(new(StatusResponse))
+	gorpc.RegisterType(new(DailyRankingRequest))
+	gorpc.RegisterType(new(DailyRankingResponse))
+	gorpc.RegisterType(new(TeamInfoRequest))
+	gorpc.RegisterType(new(TeamInfoResponse))
+	gorpc.RegisterType(new(TeamRankingRequest))
+	gorpc.RegisterType(new(TeamRankingResponse))
+	gorpc.RegisterType(new(PruneBattleRecordsRequest))
+	gorpc.RegisterType(new(PruneBattleRecordsResponse))
 }
 
 type RegisterProxyRequest struct {
@@ -66,3 +75,75 @@ type StatusResponse struct {
 	LobbyUsers []User
 	Battles    []Battle
 }
+
+// DailyRankingRequest asks for the win-count leaderboard of one daily
+// cycle. Date is "YYYY-MM-DD" (UTC); an empty Date means today's
+// still-live ranking. There's only one leaderboard lifecycle (daily) -
+// see db.PeriodicRankingReset - so there's no Period to select here.
+type DailyRankingRequest struct {
+	Date string
+}
+
+type RankingEntry struct {
+	Rank   int
+	UserID string
+	Name   string
+	Team   string
+	Win    int64
+	Lose   int64
+	Kill   int64
+	Death  int64
+}
+
+type DailyRankingResponse struct {
+	Result  bool
+	Message string
+	Date    string
+	Ranking []RankingEntry
+}
+
+// TeamInfoRequest asks for one team's roster, looked up by tag.
+type TeamInfoRequest struct {
+	Tag string
+}
+
+type TeamInfoResponse struct {
+	Result  bool
+	Message string
+	TeamID  string
+	Tag     string
+	Name    string
+	Roster  []User
+}
+
+// TeamRankingRequest asks for the team win-count leaderboard.
+type TeamRankingRequest struct {
+}
+
+type TeamRankingEntry struct {
+	Rank   int
+	TeamID string
+	Tag    string
+	Name   string
+	Win    int64
+	Lose   int64
+	Kill   int64
+}
+
+type TeamRankingResponse struct {
+	Result  bool
+	Message string
+	Ranking []TeamRankingEntry
+}
+
+// PruneBattleRecordsRequest is an admin-only request that forces an
+// immediate battle_record retention sweep, moving every row created
+// before Before into the archive table ahead of the next scheduled run.
+type PruneBattleRecordsRequest struct {
+	Before time.Time
+}
+
+type PruneBattleRecordsResponse struct {
+	Result  bool
+	Message string
+}